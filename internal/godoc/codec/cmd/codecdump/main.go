@@ -0,0 +1,36 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The codecdump command prints an annotated, indented representation of a
+// file encoded by the codec package. It is the analogue of gob's debug
+// tooling, and is useful for diagnosing corrupt cache entries or schema
+// drift without needing the original Go types to still match.
+//
+// Usage:
+//
+//	codecdump file
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/pkgsite/internal/godoc/codec"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: codecdump file")
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := codec.Dump(os.Stdout, data); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -5,9 +5,10 @@
 // Package codec implements the general-purpose part of an encoder for Go
 // values. It relies on code generation rather than reflection so it is
 // significantly faster than reflection-based encoders like gob. It also
-// preserves sharing among struct pointers (but not other forms of sharing, like
-// sub-slices). These features are sufficient for encoding the structures of the
-// go/ast package, which is its sole purpose.
+// preserves sharing among struct pointers, and, for []byte with an Encoder
+// constructed with ShareSlices set, sharing of overlapping sub-slices of the
+// same backing array. These features are sufficient for encoding the
+// structures of the go/ast package, which is its sole purpose.
 package codec
 
 import (
@@ -16,6 +17,8 @@ import (
 	"math"
 	"reflect"
 	"runtime"
+	"sort"
+	"unsafe"
 )
 
 // An Encoder encodes Go values into a sequence of bytes.
@@ -24,16 +27,54 @@ import (
 // - Call the Encode method one or more times.
 // - Retrieve the resulting bytes by calling Bytes.
 type Encoder struct {
-	buf      []byte
-	typeNums map[reflect.Type]int
-	seen     map[interface{}]uint64 // for references; see StartStruct
+	buf         []byte
+	typeNums    map[reflect.Type]int
+	typeNames   []string               // type names, in the order their numbers were assigned
+	seen        map[interface{}]uint64 // for references; see StartStruct
+	varint      bool                   // see EncoderOpts.Varint
+	sortMapKeys bool                   // see EncoderOpts.SortMapKeys
+	shareSlices bool                   // see EncoderOpts.ShareSlices
+	sliceBases  []sliceBase            // backing arrays seen so far; see encodeBytesShared
 }
 
 // NewEncoder returns an Encoder.
 func NewEncoder() *Encoder {
+	return NewEncoderOpts(EncoderOpts{SortMapKeys: true})
+}
+
+// EncoderOpts holds options for NewEncoderOpts.
+type EncoderOpts struct {
+	// Varint enables a variable-length encoding for unsigned and signed
+	// integers that don't fit into the initial byte, trading some CPU for a
+	// smaller encoded size. See the "Encoding Scheme" comment below.
+	Varint bool
+
+	// SortMapKeys sorts a map's keys before encoding them, for maps whose
+	// keys are comparable primitives (string, int, uint, or float
+	// varieties). This keeps the encoding deterministic, which matters for
+	// content-addressed caches. NewEncoder sets this by default; callers of
+	// NewEncoderOpts must opt in explicitly.
+	SortMapKeys bool
+
+	// ShareSlices preserves sharing between []byte values that overlap the
+	// same backing array, the way StartStruct preserves sharing between
+	// struct pointers. Without it, each []byte is encoded independently, so
+	// overlapping sub-slices (e.g. a header and body carved out of one
+	// read buffer) are duplicated in the output. Sharing is preserved only
+	// for a []byte that lies wholly within a []byte encoded earlier, counting
+	// from that one's first byte to the end of its capacity; any other
+	// overlapping []byte is encoded with its own copy of the bytes.
+	ShareSlices bool
+}
+
+// NewEncoderOpts returns an Encoder configured according to opts.
+func NewEncoderOpts(opts EncoderOpts) *Encoder {
 	return &Encoder{
-		typeNums: map[reflect.Type]int{},
-		seen:     map[interface{}]uint64{},
+		typeNums:    map[reflect.Type]int{},
+		seen:        map[interface{}]uint64{},
+		varint:      opts.Varint,
+		sortMapKeys: opts.SortMapKeys,
+		shareSlices: opts.ShareSlices,
 	}
 }
 
@@ -84,10 +125,11 @@ func (e *Encoder) Bytes() []byte {
 // - Pass NewDecoder the return value of Encoder.Bytes.
 // - Call the Decode method once for each call to Encoder.Encode.
 type Decoder struct {
-	buf       []byte
-	i         int
-	typeInfos []*typeInfo
-	refs      []interface{} // list of struct pointers, in the order seen
+	buf        []byte
+	i          int
+	typeInfos  []*typeInfo
+	refs       []interface{} // list of struct pointers, in the order seen
+	sliceBases [][]byte      // backing arrays seen so far; see decodeBytesShared
 }
 
 // NewDecoder returns a Decoder for the given bytes.
@@ -199,26 +241,46 @@ func (d *Decoder) readUint64() uint64 {
 //
 // Unsigned integers that can't fit into the initial byte are encoded as byte
 // sequences of length 4 or 8, holding little-endian uint32 or uint64 values. We
-// use uint32s where possible to save space. We could have saved more space by
-// also considering 16-byte numbers, or using a variable-length encoding like
-// varints or gob's representation, but it didn't seem worth the additional
-// complexity.
+// use uint32s where possible to save space.
+//
+// An Encoder constructed with NewEncoderOpts and Varint set to true instead
+// encodes such integers the way gob does: a single length byte (the count of
+// bytes that follow, 1 to 8), then that many big-endian bytes, using the
+// minimum number of bytes needed to hold the value. This is denser for the
+// many small-but-not-tiny integers (positions, offsets, small counts) found in
+// types like go/ast, at the cost of a little more work encoding and decoding.
 //
 // The nValues code is for sequences of values whose size is known beforehand,
 // like a Go slice or array. The slice []string{"hi", "bye"} is encoded as
 //   nValues 2 nBytes 2 'h' 'i' nBytes 3 'b' 'y' 'e'
 //
+// The nMap code is like nValues, but for maps: a uint n follows, then 2n
+// values, alternating keys and values (key0, val0, key1, val1, ...). To keep
+// the encoding deterministic, an Encoder with SortMapKeys set sorts the keys
+// first when they are comparable primitives (the string/int/uint/float
+// varieties); otherwise it falls back to Go's randomized map iteration order.
+//
 // The ref code is used to refer to an earlier encoded value. It is followed by
 // a uint denoting the index data of the value to use.
 //
+// The sliceRef code is used by an Encoder with ShareSlices set to encode a
+// []byte as a view onto a backing array: a uint offset, a uint length, and a
+// uint ref follow. If ref names a backing array seen before, offset and
+// length select the sub-slice of it to use. Otherwise this []byte is itself
+// a new backing array: offset is 0, and the array's bytes (its full
+// capacity, not just len(b)) follow as an ordinary nBytes value, so a later,
+// overlapping []byte can refer to bytes beyond this one's length.
+//
 // The start and end codes delimit a value whose length is unknown beforehand.
 // It is used for structs.
 const (
 	nilCode = 255 - iota // a nil value
-	// reserve a few values for future use
-	reserved1
-	reserved2
-	reserved3
+	// varintCode: a byte n (1-8) follows, then n big-endian bytes holding the
+	// minimum representation of the value. Only used by Encoders with Varint
+	// set; see EncodeUint.
+	varintCode
+	nMapCode     // uint n follows, then 2n values: key0, val0, key1, val1, ...
+	sliceRefCode // uint offset, uint len, uint ref follow; see ShareSlices
 	reserved4
 	reserved5
 	reserved6
@@ -237,6 +299,8 @@ func (e *Encoder) EncodeUint(u uint64) {
 	case u < endCode:
 		// u fits into the initial byte.
 		e.writeByte(byte(u))
+	case e.varint:
+		e.encodeUintVarint(u)
 	case u <= math.MaxUint32:
 		// Encode as a sequence of 4 bytes, the little-endian representation of
 		// a uint32.
@@ -252,6 +316,23 @@ func (e *Encoder) EncodeUint(u uint64) {
 	}
 }
 
+// encodeUintVarint encodes u (which is >= endCode) as varintCode, a length
+// byte giving the number of bytes that follow (1 to 8), and that many
+// big-endian bytes holding the minimum representation of u.
+func (e *Encoder) encodeUintVarint(u uint64) {
+	var buf [8]byte
+	n := 0
+	for ; u > 0; u >>= 8 {
+		buf[n] = byte(u)
+		n++
+	}
+	e.writeByte(varintCode)
+	e.writeByte(byte(n))
+	for i := n - 1; i >= 0; i-- {
+		e.writeByte(buf[i])
+	}
+}
+
 // DecodeUint decodes a uint64.
 func (d *Decoder) DecodeUint() uint64 {
 	b := d.readByte()
@@ -267,6 +348,16 @@ func (d *Decoder) DecodeUint() uint64 {
 		default:
 			d.failf("DecodeUint: bad length %d", n)
 		}
+	case b == varintCode:
+		n := d.readByte()
+		if n == 0 || n > 8 {
+			d.failf("DecodeUint: bad varint length %d", n)
+		}
+		var u uint64
+		for _, c := range d.readBytes(int(n)) {
+			u = u<<8 | uint64(c)
+		}
+		return u
 	default:
 		d.badcode(b)
 	}
@@ -321,6 +412,76 @@ func (d *Decoder) DecodeBytes() []byte {
 	return d.readBytes(d.decodeLen())
 }
 
+// A sliceBase records a backing array that an Encoder with ShareSlices set
+// has encoded, so a later []byte that overlaps it can be encoded as a
+// reference instead of duplicating its bytes.
+type sliceBase struct {
+	ptr uintptr // address of the array's first byte, or 0 if the []byte that introduced it had length 0
+	len int     // number of bytes available at ptr (the array's capacity)
+	ref uint64  // reference number assigned to this base
+}
+
+// encodeBytesShared encodes b, preserving sharing with any previously
+// encoded []byte whose backing array it overlaps. See the sliceRef code
+// comment above.
+func (e *Encoder) encodeBytesShared(b []byte) {
+	var ptr uintptr
+	if len(b) > 0 {
+		ptr = uintptr(unsafe.Pointer(&b[0]))
+	}
+	if base, offset, ok := e.findSliceBase(ptr, len(b)); ok {
+		e.writeByte(sliceRefCode)
+		e.EncodeUint(uint64(offset))
+		e.EncodeUint(uint64(len(b)))
+		e.EncodeUint(base.ref)
+		return
+	}
+	// b's backing array hasn't been seen before: it becomes a new base. Keep
+	// its full capacity, not just len(b), so a later, overlapping []byte
+	// that reaches further into the array can still be served from it.
+	full := b[:cap(b):cap(b)]
+	ref := uint64(len(e.sliceBases))
+	e.sliceBases = append(e.sliceBases, sliceBase{ptr: ptr, len: len(full), ref: ref})
+	e.writeByte(sliceRefCode)
+	e.EncodeUint(0)
+	e.EncodeUint(uint64(len(b)))
+	e.EncodeUint(ref)
+	e.EncodeBytes(full)
+}
+
+// findSliceBase reports whether some previously-seen backing array covers
+// the n bytes of a slice starting at ptr, returning that base and the offset
+// of ptr within it.
+func (e *Encoder) findSliceBase(ptr uintptr, n int) (_ sliceBase, offset int, ok bool) {
+	for _, b := range e.sliceBases {
+		if b.len == 0 {
+			continue
+		}
+		if ptr >= b.ptr && ptr+uintptr(n) <= b.ptr+uintptr(b.len) {
+			return b, int(ptr - b.ptr), true
+		}
+	}
+	return sliceBase{}, 0, false
+}
+
+// decodeBytesShared decodes a []byte encoded by encodeBytesShared.
+func (d *Decoder) decodeBytesShared() []byte {
+	if b := d.readByte(); b != sliceRefCode {
+		d.badcode(b)
+	}
+	offset := int(d.DecodeUint())
+	length := int(d.DecodeUint())
+	ref := d.DecodeUint()
+	var base []byte
+	if int(ref) < len(d.sliceBases) {
+		base = d.sliceBases[ref]
+	} else {
+		base = d.DecodeBytes()
+		d.sliceBases = append(d.sliceBases, base)
+	}
+	return base[offset : offset+length]
+}
+
 // EncodeString encodes a string.
 func (e *Encoder) EncodeString(s string) {
 	e.encodeLen(len(s))
@@ -391,6 +552,28 @@ func (d *Decoder) StartList() int {
 	}
 }
 
+// StartMap should be called before encoding a map, with the map's length.
+// The caller follows with 2*len values, alternating keys and values.
+func (e *Encoder) StartMap(len int) {
+	e.writeByte(nMapCode)
+	e.EncodeUint(uint64(len))
+}
+
+// StartMap should be called before decoding a map. It returns -1 if the
+// encoded map was nil. Otherwise, it returns the number of entries, and the
+// caller should decode 2*n values, alternating keys and values.
+func (d *Decoder) StartMap() int {
+	switch b := d.readByte(); b {
+	case nilCode:
+		return -1
+	case nMapCode:
+		return int(d.DecodeUint())
+	default:
+		d.badcode(b)
+		return 0
+	}
+}
+
 //////////////// Struct Support
 
 // StartStruct should be called before encoding a struct pointer. The isNil
@@ -477,15 +660,37 @@ func (d *Decoder) skip() {
 		// A uint n and n bytes follow. It is efficient to call readBytes here
 		// because it does no allocation.
 		d.readBytes(int(d.DecodeUint()))
+	case varintCode:
+		// A length byte n and n bytes follow.
+		d.readBytes(int(d.readByte()))
 	case nValuesCode:
 		// A uint n and n values follow.
 		n := int(d.DecodeUint())
 		for i := 0; i < n; i++ {
 			d.skip()
 		}
+	case nMapCode:
+		// A uint n and 2n values follow.
+		n := int(d.DecodeUint())
+		for i := 0; i < 2*n; i++ {
+			d.skip()
+		}
 	case refCode:
 		// A uint follows.
 		d.DecodeUint()
+	case sliceRefCode:
+		// A uint offset and uint len follow. A uint ref follows that; if it
+		// names a backing array not seen before, an nBytes value follows.
+		// Ref numbers are assigned positionally by the encoder regardless of
+		// whether the decoder skips or decodes a value, so a new base must
+		// be recorded here exactly as decodeBytesShared does, to keep
+		// d.sliceBases in sync with the encoder's numbering.
+		d.DecodeUint()
+		d.DecodeUint()
+		ref := d.DecodeUint()
+		if int(ref) >= len(d.sliceBases) {
+			d.sliceBases = append(d.sliceBases, d.DecodeBytes())
+		}
 	case startCode:
 		// Skip until we see endCode.
 		for d.curByte() != endCode {
@@ -518,6 +723,7 @@ func (e *Encoder) EncodeAny(x interface{}) {
 	if !ok {
 		num = len(e.typeNums)
 		e.typeNums[t] = num
+		e.typeNames = append(e.typeNames, typeName(t))
 	}
 	// Encode a pair (2-element list) of the type number and the encoded value.
 	e.StartList(2)
@@ -550,12 +756,8 @@ func (d *Decoder) DecodeAny() interface{} {
 func (e *Encoder) encodeInitial() {
 	// Encode the list of type names we saw, in the order we
 	// assigned numbers to them.
-	names := make([]string, len(e.typeNums))
-	for t, num := range e.typeNums {
-		names[num] = typeName(t)
-	}
-	e.StartList(len(names))
-	for _, n := range names {
+	e.StartList(len(e.typeNames))
+	for _, n := range e.typeNames {
 		e.EncodeString(n)
 	}
 }
@@ -584,9 +786,10 @@ func (d *Decoder) decodeInitial() {
 
 // A typeInfo describes how to encode and decode a type.
 type typeInfo struct {
-	name   string // e.g. "go/ast.File"
-	encode encodeFunc
-	decode decodeFunc
+	name      string // e.g. "go/ast.File"
+	encode    encodeFunc
+	decode    decodeFunc
+	marshaler bool // encode calls Marshaler.CodecEncode; see marshalerEncodeFunc
 }
 
 type (
@@ -599,17 +802,119 @@ var (
 	typeInfosByType = map[reflect.Type]*typeInfo{}
 )
 
-// Register records the type of x for use by Encoders and Decoders.
+// Marshaler is the interface implemented by a type that encodes itself,
+// bypassing the enc func that would otherwise be passed to Register.
+//
+// The output of CodecEncode is wrapped in a startCode/endCode pair, so skip
+// always sees exactly one value; between them, CodecEncode may write any
+// sequence of complete values. Note that reference-sharing via StartStruct is
+// bypassed for types registered this way: CodecEncode is called every time,
+// never replaced by a ref to an earlier encoding.
+type Marshaler interface {
+	CodecEncode(e *Encoder)
+}
+
+// Unmarshaler is the interface implemented by a type that decodes itself,
+// bypassing the dec func that would otherwise be passed to Register. A
+// CodecDecode implementation must consume exactly the values written by the
+// corresponding CodecEncode. See Marshaler.
+type Unmarshaler interface {
+	CodecDecode(d *Decoder)
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// marshalerEncodeFunc returns an encodeFunc that calls CodecEncode if t or
+// a pointer to t implements Marshaler, or nil if neither does.
+func marshalerEncodeFunc(t reflect.Type) encodeFunc {
+	switch {
+	case t.Implements(marshalerType):
+		return func(e *Encoder, x interface{}) {
+			e.writeByte(startCode)
+			x.(Marshaler).CodecEncode(e)
+			e.writeByte(endCode)
+		}
+	case reflect.PtrTo(t).Implements(marshalerType):
+		return func(e *Encoder, x interface{}) {
+			e.writeByte(startCode)
+			p := reflect.New(t)
+			p.Elem().Set(reflect.ValueOf(x))
+			p.Interface().(Marshaler).CodecEncode(e)
+			e.writeByte(endCode)
+		}
+	default:
+		return nil
+	}
+}
+
+// unmarshalerDecodeFunc returns a decodeFunc that calls CodecDecode if t or
+// a pointer to t implements Unmarshaler, or nil if neither does. The
+// returned value always has type t, matching what Register was called with.
+// It consumes the startCode/endCode pair that marshalerEncodeFunc wraps
+// CodecEncode's output in, so CodecDecode only ever sees its own data.
+func unmarshalerDecodeFunc(t reflect.Type) decodeFunc {
+	switch {
+	case t.Kind() == reflect.Ptr && t.Implements(unmarshalerType):
+		return func(d *Decoder) interface{} {
+			d.startUnmarshal()
+			p := reflect.New(t.Elem())
+			p.Interface().(Unmarshaler).CodecDecode(d)
+			d.endUnmarshal()
+			return p.Interface()
+		}
+	case reflect.PtrTo(t).Implements(unmarshalerType):
+		return func(d *Decoder) interface{} {
+			d.startUnmarshal()
+			p := reflect.New(t)
+			p.Interface().(Unmarshaler).CodecDecode(d)
+			d.endUnmarshal()
+			return p.Elem().Interface()
+		}
+	default:
+		return nil
+	}
+}
+
+// startUnmarshal consumes the startCode written by marshalerEncodeFunc.
+func (d *Decoder) startUnmarshal() {
+	if b := d.readByte(); b != startCode {
+		d.badcode(b)
+	}
+}
+
+// endUnmarshal consumes the endCode written by marshalerEncodeFunc.
+func (d *Decoder) endUnmarshal() {
+	if b := d.readByte(); b != endCode {
+		d.badcode(b)
+	}
+}
+
+// Register records the type of x for use by Encoders and Decoders. If x (or
+// a pointer to it) implements Marshaler and/or Unmarshaler, enc and/or dec
+// may be nil: the corresponding CodecEncode/CodecDecode method is used
+// instead.
 func Register(x interface{}, enc encodeFunc, dec decodeFunc) {
 	t := reflect.TypeOf(x)
 	tn := typeName(t)
 	if _, ok := typeInfosByName[tn]; ok {
 		panic(fmt.Sprintf("codec.Register: duplicate type %s (typeName=%q)", t, tn))
 	}
+	isMarshaler := false
+	if me := marshalerEncodeFunc(t); me != nil {
+		enc = me
+		isMarshaler = true
+	}
+	if md := unmarshalerDecodeFunc(t); md != nil {
+		dec = md
+	}
 	ti := &typeInfo{
-		name:   tn,
-		encode: enc,
-		decode: dec,
+		name:      tn,
+		encode:    enc,
+		decode:    dec,
+		marshaler: isMarshaler,
 	}
 	typeInfosByName[ti.name] = ti
 	typeInfosByType[t] = ti
@@ -623,6 +928,30 @@ func typeName(t reflect.Type) string {
 	return t.PkgPath() + "." + t.Name()
 }
 
+// stringMapKeys returns the keys of m, sorted if sorted is true.
+func stringMapKeys(m map[string]string, sorted bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if sorted {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+// interfaceMapKeys returns the keys of m, sorted if sorted is true.
+func interfaceMapKeys(m map[string]interface{}, sorted bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if sorted {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
 var builtinTypes []reflect.Type
 
 func init() {
@@ -645,8 +974,72 @@ func init() {
 		func(e *Encoder, x interface{}) { e.EncodeString(x.(string)) },
 		func(d *Decoder) interface{} { return d.DecodeString() })
 	Register([]byte(nil),
-		func(e *Encoder, x interface{}) { e.EncodeBytes(x.([]byte)) },
-		func(d *Decoder) interface{} { return d.DecodeBytes() })
+		func(e *Encoder, x interface{}) {
+			b := x.([]byte)
+			if e.shareSlices {
+				e.encodeBytesShared(b)
+				return
+			}
+			e.EncodeBytes(b)
+		},
+		func(d *Decoder) interface{} {
+			if d.curByte() == sliceRefCode {
+				return d.decodeBytesShared()
+			}
+			return d.DecodeBytes()
+		})
+	Register(map[string]string(nil),
+		func(e *Encoder, x interface{}) {
+			m := x.(map[string]string)
+			if m == nil {
+				e.EncodeNil()
+				return
+			}
+			keys := stringMapKeys(m, e.sortMapKeys)
+			e.StartMap(len(keys))
+			for _, k := range keys {
+				e.EncodeString(k)
+				e.EncodeString(m[k])
+			}
+		},
+		func(d *Decoder) interface{} {
+			n := d.StartMap()
+			if n < 0 {
+				return map[string]string(nil)
+			}
+			m := make(map[string]string, n)
+			for i := 0; i < n; i++ {
+				k := d.DecodeString()
+				m[k] = d.DecodeString()
+			}
+			return m
+		})
+	Register(map[string]interface{}(nil),
+		func(e *Encoder, x interface{}) {
+			m := x.(map[string]interface{})
+			if m == nil {
+				e.EncodeNil()
+				return
+			}
+			keys := interfaceMapKeys(m, e.sortMapKeys)
+			e.StartMap(len(keys))
+			for _, k := range keys {
+				e.EncodeString(k)
+				e.EncodeAny(m[k])
+			}
+		},
+		func(d *Decoder) interface{} {
+			n := d.StartMap()
+			if n < 0 {
+				return map[string]interface{}(nil)
+			}
+			m := make(map[string]interface{}, n)
+			for i := 0; i < n; i++ {
+				k := d.DecodeString()
+				m[k] = d.DecodeAny()
+			}
+			return m
+		})
 
 	for t := range typeInfosByType {
 		builtinTypes = append(builtinTypes, t)
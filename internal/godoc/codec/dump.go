@@ -0,0 +1,177 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump writes an annotated, indented representation of data, a byte slice
+// produced by an Encoder, to w. It is the analogue of gob's debug.go, useful
+// for diagnosing corrupt cache entries or schema drift once UnknownField
+// starts silently discarding data.
+//
+// Unlike Decoder, Dump never calls a registered decode function, so it works
+// even when a type's Go definition has changed since the data was encoded.
+// It walks the buffer the same way skip does, using only the low-level
+// buffer readers, and resolves type numbers to names using the type-name
+// table at the start of data.
+func Dump(w io.Writer, data []byte) (err error) {
+	defer func() { handlePanic(&err, recover()) }()
+	d := NewDecoder(data)
+	dp := &dumper{w: w}
+	dp.names = d.dumpTypeNames()
+	for d.i < len(d.buf) {
+		dp.dumpAny(d, 0)
+	}
+	return dp.err
+}
+
+// dumpTypeNames decodes the type-name table written by encodeInitial,
+// without looking the names up in typeInfosByName.
+func (d *Decoder) dumpTypeNames() []string {
+	n := d.StartList()
+	names := make([]string, n)
+	for i := range names {
+		names[i] = d.DecodeString()
+	}
+	return names
+}
+
+// A dumper holds the state for a single call to Dump.
+type dumper struct {
+	w           io.Writer
+	err         error
+	names       []string // type names, indexed by type number
+	nref        uint64   // number of startCode values seen so far; see StartStruct
+	nSliceBases uint64   // number of sliceRefCode bases seen so far; see ShareSlices
+}
+
+// line writes one indented, newline-terminated line of output.
+func (dp *dumper) line(indent int, format string, args ...interface{}) {
+	if dp.err != nil {
+		return
+	}
+	_, dp.err = fmt.Fprintf(dp.w, "%s%s\n", strings.Repeat("    ", indent), fmt.Sprintf(format, args...))
+}
+
+// dumpAny dumps one value encoded by EncodeAny: either the nil-interface
+// marker, or a (type number, value) pair.
+func (dp *dumper) dumpAny(d *Decoder, indent int) {
+	if d.curByte() == 0 {
+		d.readByte()
+		dp.line(indent, "nil")
+		return
+	}
+	n := d.StartList()
+	if n != 2 {
+		dp.line(indent, "<malformed top-level value: list of length %d>", n)
+		return
+	}
+	num := d.DecodeUint()
+	label := fmt.Sprintf("type#%d", num)
+	var ti *typeInfo
+	if int(num) < len(dp.names) {
+		label = dp.names[num]
+		ti = typeInfosByName[label]
+		if ti == nil {
+			label += " (unregistered)"
+		}
+	}
+	dp.line(indent, "%s:", label)
+	if ti != nil && ti.marshaler {
+		dp.marshaledValue(d, indent+1)
+		return
+	}
+	dp.value(d, indent+1)
+}
+
+// marshaledValue dumps the content written by a Marshaler-registered type's
+// CodecEncode: a startCode, then zero or more plain values (whatever
+// CodecEncode chose to write, with no field numbers), then endCode. This
+// differs from a struct's startCode, whose contents are (field number,
+// value) pairs; treating one as the other would misread everything that
+// follows in the stream. Like skip's startCode case, this loops until
+// endCode rather than assuming a single value, since CodecEncode is free to
+// write more than one (marshalPoint, for example, writes two ints).
+func (dp *dumper) marshaledValue(d *Decoder, indent int) {
+	if b := d.readByte(); b != startCode {
+		dp.line(indent, "<expected startCode for marshaled value, got %d>", b)
+		return
+	}
+	for d.curByte() != endCode {
+		dp.value(d, indent)
+	}
+	d.readByte() // consume endCode
+}
+
+// value dumps the single value at the decoder's current position, the same
+// way skip does, but prints annotated, indented lines instead of just
+// consuming bytes.
+func (dp *dumper) value(d *Decoder, indent int) {
+	b := d.readByte()
+	if b < endCode {
+		dp.line(indent, "%d", b)
+		return
+	}
+	switch b {
+	case nilCode:
+		dp.line(indent, "nil")
+	case varintCode:
+		n := d.readByte()
+		var u uint64
+		for _, c := range d.readBytes(int(n)) {
+			u = u<<8 | uint64(c)
+		}
+		dp.line(indent, "%d (varint)", u)
+	case nBytesCode:
+		n := int(d.DecodeUint())
+		b := d.readBytes(n)
+		dp.line(indent, "%d bytes: %q", n, b)
+	case nValuesCode:
+		n := int(d.DecodeUint())
+		dp.line(indent, "list of %d:", n)
+		for i := 0; i < n; i++ {
+			dp.value(d, indent+1)
+		}
+	case nMapCode:
+		n := int(d.DecodeUint())
+		dp.line(indent, "map of %d:", n)
+		for i := 0; i < n; i++ {
+			dp.line(indent+1, "key:")
+			dp.value(d, indent+2)
+			dp.line(indent+1, "value:")
+			dp.value(d, indent+2)
+		}
+	case refCode:
+		u := d.DecodeUint()
+		dp.line(indent, "ref -> #%d", u)
+	case sliceRefCode:
+		offset := d.DecodeUint()
+		length := d.DecodeUint()
+		ref := d.DecodeUint()
+		if ref < dp.nSliceBases {
+			dp.line(indent, "slice [%d:%d] of base #%d", offset, offset+length, ref)
+		} else {
+			dp.nSliceBases++
+			dp.line(indent, "slice [%d:%d] of new base #%d:", offset, offset+length, ref)
+			dp.value(d, indent+1)
+		}
+	case startCode:
+		num := dp.nref
+		dp.nref++
+		dp.line(indent, "struct #%d:", num)
+		for d.curByte() != endCode {
+			field := d.DecodeUint()
+			dp.line(indent+1, "#%d:", field)
+			dp.value(d, indent+2)
+		}
+		d.readByte() // consume endCode
+	default:
+		dp.line(indent, "<reserved code %d>", b)
+	}
+}
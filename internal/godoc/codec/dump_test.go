@@ -0,0 +1,172 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// dumpMustSucceed dumps data and fails the test if Dump returns an error.
+func dumpMustSucceed(t *testing.T, data []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Dump(&buf, data); err != nil {
+		t.Fatalf("Dump failed: %v\noutput so far:\n%s", err, buf.String())
+	}
+	return buf.String()
+}
+
+// TestDumpBasicValues checks that Dump handles the built-in scalar, list and
+// map encodings without error.
+func TestDumpBasicValues(t *testing.T) {
+	e := NewEncoder()
+	if err := e.Encode(17); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(map[string]interface{}{"n": 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := dumpMustSucceed(t, e.Bytes())
+	// 17 is zig-zag encoded to 34 by EncodeInt; Dump shows the raw encoded
+	// value, not the decoded one, since it never calls a decode function.
+	for _, want := range []string{"34", "hello", "map of 2:", "map of 1:"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+type dumpNode struct {
+	Val  int
+	Next *dumpNode
+}
+
+func encodeDumpNode(e *Encoder, x interface{}) {
+	n := x.(*dumpNode)
+	if !e.StartStruct(n == nil, n) {
+		return
+	}
+	e.EncodeUint(0)
+	e.EncodeInt(int64(n.Val))
+	if n.Next != nil {
+		e.EncodeUint(1)
+		e.EncodeAny(n.Next)
+	}
+	e.EndStruct()
+}
+
+func decodeDumpNode(d *Decoder) interface{} {
+	proceed, ref := d.StartStruct()
+	if !proceed {
+		return (*dumpNode)(nil)
+	}
+	if ref != nil {
+		return ref
+	}
+	n := &dumpNode{}
+	d.StoreRef(n)
+	for {
+		f := d.NextStructField()
+		if f == -1 {
+			break
+		}
+		switch f {
+		case 0:
+			n.Val = int(d.DecodeInt())
+		case 1:
+			n.Next = d.DecodeAny().(*dumpNode)
+		default:
+			d.UnknownField("codec.dumpNode", f)
+		}
+	}
+	return n
+}
+
+// TestDumpStructAndRef checks that Dump prints structs with field numbers
+// and prints a shared struct pointer as a ref rather than re-encoding it.
+func TestDumpStructAndRef(t *testing.T) {
+	Register(&dumpNode{}, encodeDumpNode, decodeDumpNode)
+
+	shared := &dumpNode{Val: 1}
+	root := &dumpNode{Val: 2, Next: shared}
+
+	e := NewEncoder()
+	if err := e.Encode(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(shared); err != nil {
+		t.Fatal(err)
+	}
+
+	out := dumpMustSucceed(t, e.Bytes())
+	for _, want := range []string{"struct #0:", "struct #1:", "ref -> #1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+type dumpMarshalPair struct {
+	A, B int
+}
+
+func (p *dumpMarshalPair) CodecEncode(e *Encoder) {
+	e.EncodeInt(int64(p.A))
+	e.EncodeInt(int64(p.B))
+}
+
+func (p *dumpMarshalPair) CodecDecode(d *Decoder) {
+	p.A = int(d.DecodeInt())
+	p.B = int(d.DecodeInt())
+}
+
+// TestDumpMarshaler checks that Dump can walk a Marshaler-encoded value that
+// writes more than one value inside its startCode/endCode wrapper, as
+// CodecEncode is entitled to do.
+func TestDumpMarshaler(t *testing.T) {
+	Register(dumpMarshalPair{}, nil, nil)
+
+	e := NewEncoder()
+	if err := e.Encode(dumpMarshalPair{A: 3, B: -4}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := dumpMustSucceed(t, e.Bytes())
+	if !strings.Contains(out, "dumpMarshalPair") {
+		t.Errorf("output does not name the type:\n%s", out)
+	}
+}
+
+// TestDumpShareSlices checks that Dump can walk a buffer produced by an
+// Encoder with ShareSlices set, across multiple top-level Encode calls that
+// share a backing array.
+func TestDumpShareSlices(t *testing.T) {
+	s := make([]byte, 20)
+	a, b := s[0:10], s[5:20]
+
+	e := NewEncoderOpts(EncoderOpts{SortMapKeys: true, ShareSlices: true})
+	if err := e.Encode(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(b); err != nil {
+		t.Fatal(err)
+	}
+
+	out := dumpMustSucceed(t, e.Bytes())
+	for _, want := range []string{"new base", "slice ["} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+}
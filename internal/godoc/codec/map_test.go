@@ -0,0 +1,144 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMapStringString(t *testing.T) {
+	for _, want := range []map[string]string{
+		{"a": "1", "b": "2", "c": "3"},
+		{},
+		nil,
+	} {
+		e := NewEncoder()
+		if err := e.Encode(want); err != nil {
+			t.Fatal(err)
+		}
+		d := NewDecoder(e.Bytes())
+		got, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+}
+
+func TestMapStringInterface(t *testing.T) {
+	for _, want := range []map[string]interface{}{
+		{"n": int64(42), "s": "hi", "b": true},
+		{},
+		nil,
+	} {
+		e := NewEncoder()
+		if err := e.Encode(want); err != nil {
+			t.Fatal(err)
+		}
+		d := NewDecoder(e.Bytes())
+		got, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+}
+
+// TestMapSortKeysDeterministic checks that an Encoder with SortMapKeys set
+// (the NewEncoder default) encodes a map the same way regardless of Go's
+// randomized map iteration order.
+func TestMapSortKeysDeterministic(t *testing.T) {
+	m := map[string]string{"z": "1", "a": "2", "m": "3", "b": "4"}
+	var first []byte
+	for i := 0; i < 10; i++ {
+		e := NewEncoder()
+		if err := e.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		data := e.Bytes()
+		if first == nil {
+			first = data
+			continue
+		}
+		if string(data) != string(first) {
+			t.Fatalf("encoding not deterministic across runs with SortMapKeys set")
+		}
+	}
+}
+
+type mapField struct {
+	M map[string]string
+}
+
+func encodeMapField(e *Encoder, x interface{}) {
+	v := x.(*mapField)
+	if !e.StartStruct(v == nil, v) {
+		return
+	}
+	e.EncodeUint(0)
+	e.EncodeAny(v.M)
+	e.EndStruct()
+}
+
+// decodeMapFieldSkip decodes a mapField but treats its only field as
+// unknown, forcing skip() to step over an nMapCode value.
+func decodeMapFieldSkip(d *Decoder) interface{} {
+	proceed, ref := d.StartStruct()
+	if !proceed {
+		return (*mapField)(nil)
+	}
+	if ref != nil {
+		return ref
+	}
+	v := &mapField{}
+	d.StoreRef(v)
+	for {
+		f := d.NextStructField()
+		if f == -1 {
+			break
+		}
+		d.UnknownField("codec.mapField", f)
+	}
+	return v
+}
+
+// TestSkipMapField checks that skip() correctly steps over a map-valued
+// struct field, as UnknownField requires for forward/backward compatibility.
+func TestSkipMapField(t *testing.T) {
+	Register(&mapField{}, encodeMapField, decodeMapFieldSkip)
+
+	v := &mapField{M: map[string]string{"a": "1", "b": "2"}}
+	e := NewEncoder()
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	// Encode a second value afterward, to confirm skip left the decoder
+	// positioned correctly rather than over- or under-consuming.
+	if err := e.Encode(99); err != nil {
+		t.Fatal(err)
+	}
+	data := e.Bytes()
+
+	d := NewDecoder(data)
+	got, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotv := got.(*mapField); gotv.M != nil {
+		t.Errorf("got M = %#v, want nil (field was skipped)", gotv.M)
+	}
+	next, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 99 {
+		t.Errorf("got %v after skipped map field, want 99", next)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import "testing"
+
+type marshalPoint struct {
+	X, Y int
+}
+
+func (p *marshalPoint) CodecEncode(e *Encoder) {
+	e.EncodeInt(int64(p.X))
+	e.EncodeInt(int64(p.Y))
+}
+
+func (p *marshalPoint) CodecDecode(d *Decoder) {
+	p.X = int(d.DecodeInt())
+	p.Y = int(d.DecodeInt())
+}
+
+func TestMarshalerUnmarshaler(t *testing.T) {
+	Register(marshalPoint{}, nil, nil)
+
+	want := marshalPoint{X: 3, Y: -4}
+	e := NewEncoder()
+	if err := e.Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(e.Bytes())
+	got, err := d.Decode()
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
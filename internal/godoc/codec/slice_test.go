@@ -0,0 +1,123 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import "testing"
+
+// TestShareSlicesOverlap checks that an Encoder with ShareSlices set
+// preserves sharing between two []byte values that overlap the same backing
+// array: decoding should yield slices that still point into one underlying
+// array, not independent copies.
+func TestShareSlicesOverlap(t *testing.T) {
+	s := make([]byte, 1024)
+	a, b := s[0:10], s[5:20]
+
+	e := NewEncoderOpts(EncoderOpts{SortMapKeys: true, ShareSlices: true})
+	if err := e.Encode(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(b); err != nil {
+		t.Fatal(err)
+	}
+	data := e.Bytes()
+
+	d := NewDecoder(data)
+	v1, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	da, db := v1.([]byte), v2.([]byte)
+	if &da[5] != &db[0] {
+		t.Errorf("decoded slices do not share a backing array: &da[5]=%p, &db[0]=%p", &da[5], &db[0])
+	}
+}
+
+type twoByteFields struct {
+	A []byte
+	B []byte
+}
+
+func encodeTwoByteFields(e *Encoder, x interface{}) {
+	v := x.(*twoByteFields)
+	if !e.StartStruct(v == nil, v) {
+		return
+	}
+	e.EncodeUint(0)
+	e.EncodeAny(v.A)
+	e.EncodeUint(1)
+	e.EncodeAny(v.B)
+	e.EndStruct()
+}
+
+// decodeTwoByteFieldsSkipA decodes a twoByteFields but treats field 0 (A) as
+// unknown, so it is skipped via UnknownField rather than decoded. This
+// exercises skip's sliceRefCode case: B's backing array must still be
+// numbered correctly even though A, the first []byte sharing that array,
+// was only skipped, not decoded.
+func decodeTwoByteFieldsSkipA(d *Decoder) interface{} {
+	proceed, ref := d.StartStruct()
+	if !proceed {
+		return (*twoByteFields)(nil)
+	}
+	if ref != nil {
+		return ref
+	}
+	v := &twoByteFields{}
+	d.StoreRef(v)
+	for {
+		f := d.NextStructField()
+		if f == -1 {
+			break
+		}
+		switch f {
+		case 1:
+			v.B = d.DecodeAny().([]byte)
+		default:
+			d.UnknownField("codec.twoByteFields", f)
+		}
+	}
+	return v
+}
+
+// TestSkipSliceRefKeepsBaseNumbering checks that skip's sliceRefCode case
+// records a newly-seen backing array in d.sliceBases exactly as
+// decodeBytesShared does, so that a later overlapping []byte whose ref was
+// assigned by the encoder still resolves to the right base even when the
+// first []byte over that base was only skipped.
+func TestSkipSliceRefKeepsBaseNumbering(t *testing.T) {
+	Register(&twoByteFields{}, encodeTwoByteFields, decodeTwoByteFieldsSkipA)
+
+	s := make([]byte, 1024)
+	for i := range s {
+		s[i] = byte(i)
+	}
+	v := &twoByteFields{A: s[0:10], B: s[5:20]}
+
+	e := NewEncoderOpts(EncoderOpts{SortMapKeys: true, ShareSlices: true})
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	data := e.Bytes()
+
+	d := NewDecoder(data)
+	got, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotv := got.(*twoByteFields)
+	want := s[5:20]
+	if len(gotv.B) != len(want) {
+		t.Fatalf("got len(B)=%d, want %d", len(gotv.B), len(want))
+	}
+	for i := range want {
+		if gotv.B[i] != want[i] {
+			t.Errorf("B[%d] = %d, want %d (ref desynced onto the wrong backing array)", i, gotv.B[i], want[i])
+		}
+	}
+}
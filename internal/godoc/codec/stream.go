@@ -0,0 +1,147 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// StreamEncoder encodes a sequence of values onto an io.Writer, one
+// length-prefixed frame per call to Encode. Unlike Encoder, whose Bytes
+// method requires every value to be held in memory until encoding is
+// finished, StreamEncoder writes each value as soon as it is encoded. This
+// is similar to how encoding/gob layers a stream of messages over an
+// io.Writer.
+//
+// The type-name metadata that Encoder writes once, up front, is instead
+// flushed lazily by StreamEncoder: once before the first value frame, and
+// again, as an extra frame, whenever a later value introduces a type that
+// hasn't been sent yet.
+type StreamEncoder struct {
+	w    *bufio.Writer
+	enc  *Encoder
+	sent int // number of typeNames already flushed
+}
+
+// NewStreamEncoder returns a StreamEncoder that writes to w.
+func NewStreamEncoder(w io.Writer) *StreamEncoder {
+	return &StreamEncoder{
+		w:   bufio.NewWriter(w),
+		enc: NewEncoder(),
+	}
+}
+
+// Frame kinds, written as the first byte of every frame.
+const (
+	valueFrame byte = iota
+	typesFrame
+)
+
+// Encode encodes x and writes it to the underlying io.Writer as a single
+// frame, first flushing a frame of newly-seen type names if x's encoding
+// introduced any.
+func (se *StreamEncoder) Encode(x interface{}) (err error) {
+	defer func() { handlePanic(&err, recover()) }()
+	se.enc.buf = nil
+	se.enc.EncodeAny(x)
+	data := se.enc.buf
+	if se.sent < len(se.enc.typeNames) {
+		se.writeFrame(typesFrame, se.newTypesData())
+	}
+	se.writeFrame(valueFrame, data)
+	return se.w.Flush()
+}
+
+// newTypesData encodes the type names assigned since the last flush, as a
+// list of strings.
+func (se *StreamEncoder) newTypesData() []byte {
+	names := se.enc.typeNames[se.sent:]
+	te := NewEncoder()
+	te.StartList(len(names))
+	for _, n := range names {
+		te.EncodeString(n)
+	}
+	se.sent = len(se.enc.typeNames)
+	return te.buf
+}
+
+// writeFrame writes a single length-prefixed frame of the given kind.
+func (se *StreamEncoder) writeFrame(kind byte, data []byte) {
+	se.w.WriteByte(kind)
+	var lbuf [4]byte
+	binary.LittleEndian.PutUint32(lbuf[:], uint32(len(data)))
+	se.w.Write(lbuf[:])
+	se.w.Write(data)
+}
+
+// StreamDecoder decodes a sequence of values written by a StreamEncoder.
+// To use a StreamDecoder, pass NewStreamDecoder the io.Reader that the
+// StreamEncoder wrote to, then call Decode once for each call to
+// StreamEncoder.Encode, in the same order.
+type StreamDecoder struct {
+	r   *bufio.Reader
+	dec *Decoder // reused across frames, so refs and sliceBases persist
+}
+
+// NewStreamDecoder returns a StreamDecoder that reads from r.
+func NewStreamDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{
+		r:   bufio.NewReader(r),
+		dec: &Decoder{},
+	}
+}
+
+// Decode decodes and returns the next value in the stream. It returns
+// io.EOF when there are no more values.
+func (sd *StreamDecoder) Decode() (_ interface{}, err error) {
+	defer func() { handlePanic(&err, recover()) }()
+	for {
+		kind, data, err := sd.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if kind == typesFrame {
+			sd.addTypes(data)
+			continue
+		}
+		sd.dec.buf = data
+		sd.dec.i = 0
+		return sd.dec.DecodeAny(), nil
+	}
+}
+
+// addTypes decodes a typesFrame's data and appends the named types to
+// dec.typeInfos.
+func (sd *StreamDecoder) addTypes(data []byte) {
+	d := &Decoder{buf: data}
+	n := d.StartList()
+	for i := 0; i < n; i++ {
+		name := d.DecodeString()
+		ti := typeInfosByName[name]
+		if ti == nil {
+			d.failf("unregistered type: %s", name)
+		}
+		sd.dec.typeInfos = append(sd.dec.typeInfos, ti)
+	}
+}
+
+// readFrame reads a single length-prefixed frame.
+func (sd *StreamDecoder) readFrame() (byte, []byte, error) {
+	kind, err := sd.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var lbuf [4]byte
+	if _, err := io.ReadFull(sd.r, lbuf[:]); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(lbuf[:]))
+	if _, err := io.ReadFull(sd.r, data); err != nil {
+		return 0, nil, err
+	}
+	return kind, data, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+type sharedNode struct {
+	Val  int
+	Next *sharedNode
+}
+
+func encodeSharedNode(e *Encoder, x interface{}) {
+	n := x.(*sharedNode)
+	if !e.StartStruct(n == nil, n) {
+		return
+	}
+	if n.Val != 0 {
+		e.EncodeUint(0)
+		e.EncodeInt(int64(n.Val))
+	}
+	if n.Next != nil {
+		e.EncodeUint(1)
+		e.EncodeAny(n.Next)
+	}
+	e.EndStruct()
+}
+
+func decodeSharedNode(d *Decoder) interface{} {
+	proceed, ref := d.StartStruct()
+	if !proceed {
+		return (*sharedNode)(nil)
+	}
+	if ref != nil {
+		return ref
+	}
+	n := &sharedNode{}
+	d.StoreRef(n)
+	for {
+		f := d.NextStructField()
+		if f == -1 {
+			break
+		}
+		switch f {
+		case 0:
+			n.Val = int(d.DecodeInt())
+		case 1:
+			n.Next = d.DecodeAny().(*sharedNode)
+		default:
+			d.UnknownField("codec.sharedNode", f)
+		}
+	}
+	return n
+}
+
+// TestStreamRefsAcrossFrames checks that struct-pointer sharing is preserved
+// across separate StreamEncoder.Encode/StreamDecoder.Decode calls, the way it
+// is within a single Encoder.Encode/Decoder.Decode call.
+func TestStreamRefsAcrossFrames(t *testing.T) {
+	Register(&sharedNode{}, encodeSharedNode, decodeSharedNode)
+
+	shared := &sharedNode{Val: 1}
+	first := &sharedNode{Val: 2, Next: shared}
+	second := &sharedNode{Val: 3, Next: shared}
+
+	var buf bytes.Buffer
+	se := NewStreamEncoder(&buf)
+	if err := se.Encode(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.Encode(second); err != nil {
+		t.Fatal(err)
+	}
+
+	sd := NewStreamDecoder(&buf)
+	got1, err := sd.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got2, err := sd.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n1 := got1.(*sharedNode)
+	n2 := got2.(*sharedNode)
+	if n1.Next != n2.Next {
+		t.Errorf("shared *sharedNode not preserved across frames: got distinct pointers %p and %p", n1.Next, n2.Next)
+	}
+}
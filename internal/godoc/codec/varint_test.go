@@ -0,0 +1,121 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"testing"
+)
+
+// TestVarintUint checks that EncodeUint/DecodeUint round-trip correctly
+// with Varint set, across the boundary values where the encoding changes
+// representation.
+func TestVarintUint(t *testing.T) {
+	for _, want := range []uint64{
+		0, 1, uint64(endCode) - 1, uint64(endCode), uint64(endCode) + 1,
+		math.MaxUint32 - 1, math.MaxUint32, math.MaxUint32 + 1,
+		math.MaxUint64 - 1, math.MaxUint64,
+	} {
+		e := NewEncoderOpts(EncoderOpts{Varint: true})
+		e.EncodeUint(want)
+		d := NewDecoder(nil)
+		d.buf = e.buf
+		got := d.DecodeUint()
+		if got != want {
+			t.Errorf("EncodeUint/DecodeUint(%d) = %d", want, got)
+		}
+	}
+}
+
+// TestVarintInt checks that EncodeInt/DecodeInt round-trip correctly with
+// Varint set, including negative values, which rely on zig-zag encoding.
+func TestVarintInt(t *testing.T) {
+	for _, want := range []int64{
+		0, 1, -1, int64(endCode) - 1, -(int64(endCode) - 1), int64(endCode), -int64(endCode),
+		math.MaxInt32, math.MinInt32, math.MaxInt64, math.MinInt64,
+	} {
+		e := NewEncoderOpts(EncoderOpts{Varint: true})
+		e.EncodeInt(want)
+		d := NewDecoder(nil)
+		d.buf = e.buf
+		got := d.DecodeInt()
+		if got != want {
+			t.Errorf("EncodeInt/DecodeInt(%d) = %d", want, got)
+		}
+	}
+}
+
+// TestVarintEncoderDecoder checks a full Encoder/Decoder round trip of a
+// varint-encoded value through the public API, not just the low-level
+// Encode/DecodeUint helpers.
+func TestVarintEncoderDecoder(t *testing.T) {
+	want := int(1 << 20)
+	e := NewEncoderOpts(EncoderOpts{Varint: true})
+	if err := e.Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(e.Bytes())
+	got, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// astPositions parses this package's own codec.go, a real ast.File, and
+// collects the position and offset values the codec package was built to
+// encode efficiently: every node's Pos and End.
+func astPositions(tb testing.TB) []int64 {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "codec.go", nil, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var positions []int64
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		positions = append(positions, int64(n.Pos()), int64(n.End()))
+		return true
+	})
+	return positions
+}
+
+// encodedSize returns the size, in bytes, of positions encoded with the
+// given Varint setting.
+func encodedSize(varint bool, positions []int64) int {
+	e := NewEncoderOpts(EncoderOpts{Varint: varint})
+	e.StartList(len(positions))
+	for _, p := range positions {
+		e.EncodeInt(p)
+	}
+	return len(e.buf)
+}
+
+// BenchmarkVarintASTFile compares the encoded size of the position and
+// offset integers of a real ast.File with and without Varint, to quantify
+// the space savings the varint encoding buys for exactly the kind of data
+// (go/ast positions) that motivated it.
+func BenchmarkVarintASTFile(b *testing.B) {
+	positions := astPositions(b)
+	b.Run("fixed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			encodedSize(false, positions)
+		}
+	})
+	b.Run("varint", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			encodedSize(true, positions)
+		}
+	})
+	b.ReportMetric(float64(encodedSize(false, positions)), "fixed-bytes")
+	b.ReportMetric(float64(encodedSize(true, positions)), "varint-bytes")
+}